@@ -2,15 +2,21 @@ package common
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
 const sessionManagerPluginName string = "session-manager-plugin"
@@ -18,18 +24,211 @@ const sessionManagerPluginName string = "session-manager-plugin"
 //sessionCommand is the AWS-SDK equivalent to the command you would specify to `aws ssm ...`
 const sessionCommand string = "StartSession"
 
+// nonInteractiveCommandDocument is the SSM document used to run a single command on the
+// target instance and capture its output, as opposed to opening an interactive shell.
+const nonInteractiveCommandDocument string = "AWS-StartNonInteractiveCommand"
+
+// exitCodeSentinelPrefix starts the line appended to the remote command's output so RunCommand can recover the
+// command's exit status from the plugin's captured stdout; AWS-StartNonInteractiveCommand
+// streams raw command output and has no structured way to report it otherwise.
+const exitCodeSentinelPrefix string = "packer-ssm-exit-code:"
+
+// TransferDirection indicates whether TransferFile is copying a local artifact up to the
+// target instance or copying a remote artifact back down to the Packer host.
+type TransferDirection string
+
+const (
+	TransferUpload   TransferDirection = "upload"
+	TransferDownload TransferDirection = "download"
+)
+
+const (
+	// transferPluginStartRetries is the number of times TransferFile will attempt to bring
+	// up the forwarding tunnel before giving up.
+	transferPluginStartRetries = 3
+	// transferPluginStartBackoff is the base delay between retries; it's doubled after each
+	// failed attempt.
+	transferPluginStartBackoff = 2 * time.Second
+	// reconnectBackoff is the base delay before StartSession's supervisor tries to
+	// re-establish a dropped tunnel; it's doubled after each failed attempt.
+	reconnectBackoff = 2 * time.Second
+	// abandonReconnectTerminateTimeout bounds the TerminateSession call abandonReconnect
+	// makes on its own background context (the supervisor's ctx may already be canceled,
+	// which is often why abandonReconnect is being called at all); without a deadline a
+	// stuck AWS API call would leak the supervisor goroutine forever.
+	abandonReconnectTerminateTimeout = 30 * time.Second
+)
+
+// disconnectMarkers are the substrings that together make up the session-manager-plugin's
+// "Connection to instance ... was closed" message. All of them must appear in a line before
+// it's classified as a disconnect; either alone is too common in unrelated output (e.g. the
+// "Connection to instance ... established" line at session start, or an unrelated "stdin was
+// closed" message) to be trusted on its own.
+var disconnectMarkers = []string{"Connection to instance", "was closed"}
+
 type SSMDriver struct {
-	Region          string
-	ProfileName     string
+	AWSConfig       aws.Config
 	Session         *ssm.StartSessionOutput
 	SessionParams   ssm.StartSessionInput
 	SessionEndpoint string
+	// EndpointResolver lets callers point SSM traffic at LocalStack or a VPC endpoint, for
+	// testing and air-gapped environments, instead of the endpoint AWSConfig resolves to.
+	EndpointResolver ssm.EndpointResolver
+	// MaxReconnects caps how many times StartSession will transparently re-establish the
+	// tunnel after it drops. Zero (the default) disables automatic reconnects.
+	MaxReconnects int
+	// RefreshSession mints a fresh SSM session before each automatic reconnect attempt.
+	// StartSession's SessionId/TokenValue are single-use, so restarting the plugin with the
+	// same Session that already opened (and lost) its stream will never succeed; this hook
+	// lets callers control how the replacement session is requested. If not set, it defaults
+	// to calling sd.client().StartSession with SessionParams.
+	RefreshSession func(ctx context.Context) (*ssm.StartSessionOutput, error)
+	// LogSink receives the plugin's output as it runs. If not specified it defaults to a
+	// JSONLogSink writing to stderr.
+	LogSink LogSink
 	// Provided for testing purposes; if not specified it defaults to sessionManagerPluginName
 	PluginName string
+
+	// mu guards pluginCmd and stopped, which are written by StartSession/superviseSession and
+	// read by Stop from a different goroutine.
+	mu sync.Mutex
+	// pluginCmd is the currently running session-manager-plugin process, tracked so Stop can
+	// kill it and release the tunnel it holds open.
+	pluginCmd *exec.Cmd
+	// stopped is closed by Stop to tell an in-flight reconnect supervisor to give up instead
+	// of re-establishing a tunnel the caller intentionally tore down.
+	stopped chan struct{}
+	// terminatedSessionID is the SessionId TerminateSession has already been called for,
+	// guarded by mu so Stop and a reconnect racing to abandon the same session don't both
+	// call TerminateSession against it.
+	terminatedSessionID string
+}
+
+// setPluginCmd records the currently running plugin process under mu.
+func (sd *SSMDriver) setPluginCmd(cmd *exec.Cmd) {
+	sd.mu.Lock()
+	sd.pluginCmd = cmd
+	sd.mu.Unlock()
+}
+
+// getPluginCmd reads the currently running plugin process under mu.
+func (sd *SSMDriver) getPluginCmd() *exec.Cmd {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.pluginCmd
+}
+
+// setSession records the session a reconnect obtained under mu, since it's written by
+// superviseSession and read by Stop from a different goroutine.
+func (sd *SSMDriver) setSession(session *ssm.StartSessionOutput) {
+	sd.mu.Lock()
+	sd.Session = session
+	sd.mu.Unlock()
+}
+
+// getSession reads the current session under mu.
+func (sd *SSMDriver) getSession() *ssm.StartSessionOutput {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.Session
+}
+
+// stopChannel lazily creates sd.stopped under mu and returns it, so StartSession and Stop
+// never race to initialize it.
+func (sd *SSMDriver) stopChannel() chan struct{} {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.stopped == nil {
+		sd.stopped = make(chan struct{})
+	}
+	return sd.stopped
+}
+
+// markStopped closes sd.stopped under mu, creating it first if Stop is called before
+// StartSession ever was.
+func (sd *SSMDriver) markStopped() {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.stopped == nil {
+		sd.stopped = make(chan struct{})
+	}
+	select {
+	case <-sd.stopped:
+	default:
+		close(sd.stopped)
+	}
+}
+
+// markTerminated records under mu that TerminateSession has been called for sessionID,
+// returning false if some other caller already claimed it. Stop and an in-flight reconnect's
+// abandonReconnect both race to tear down a session when Stop runs concurrently with a
+// reconnect, and this keeps them from double-terminating it.
+func (sd *SSMDriver) markTerminated(sessionID string) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.terminatedSessionID == sessionID {
+		return false
+	}
+	sd.terminatedSessionID = sessionID
+	return true
 }
 
-// StartSession starts an interactive Systems Manager session with a remote instance via the AWS session-manager-plugin
+// unmarkTerminated rolls back a markTerminated claim after the TerminateSession call it
+// guarded actually failed, so a later retry isn't skipped as already-done.
+func (sd *SSMDriver) unmarkTerminated(sessionID string) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.terminatedSessionID == sessionID {
+		sd.terminatedSessionID = ""
+	}
+}
+
+// refreshSession mints the session to use for a reconnect attempt, via RefreshSession if the
+// caller supplied one, or by calling StartSession on the SSM API directly otherwise.
+func (sd *SSMDriver) refreshSession(ctx context.Context) (*ssm.StartSessionOutput, error) {
+	if sd.RefreshSession != nil {
+		return sd.RefreshSession(ctx)
+	}
+
+	output, err := sd.client().StartSession(ctx, &sd.SessionParams)
+	if err != nil {
+		return nil, fmt.Errorf("error encountered starting a replacement SSM session: %s", err)
+	}
+	return output, nil
+}
+
+// client builds an SSM API client from AWSConfig, honoring EndpointResolver when the
+// caller has set one.
+func (sd *SSMDriver) client() *ssm.Client {
+	return ssm.NewFromConfig(sd.AWSConfig, func(o *ssm.Options) {
+		if sd.EndpointResolver != nil {
+			o.EndpointResolver = sd.EndpointResolver
+		}
+	})
+}
+
+// StartSession starts an interactive Systems Manager session with a remote instance via the
+// AWS session-manager-plugin. Once the tunnel is up, a supervisor goroutine keeps draining
+// the plugin's output and, if the tunnel drops and MaxReconnects is set, transparently
+// re-establishes it with exponential backoff.
 func (sd *SSMDriver) StartSession(ctx context.Context) error {
+	stopCh := sd.stopChannel()
+
+	cmd, lines, err := sd.startPlugin(ctx)
+	if err != nil {
+		return err
+	}
+	sd.setPluginCmd(cmd)
+
+	go sd.superviseSession(ctx, lines, stopCh)
+	return nil
+}
+
+// startPlugin launches the session-manager-plugin and blocks until it reports that the
+// tunnel is open. It returns the running command, so callers can eventually tear the tunnel
+// down, along with a channel that continues to receive the plugin's output lines after the
+// tunnel comes up so a caller can watch for disconnects.
+func (sd *SSMDriver) startPlugin(ctx context.Context) (*exec.Cmd, <-chan string, error) {
 	if sd.PluginName == "" {
 		sd.PluginName = sessionManagerPluginName
 	}
@@ -37,53 +236,545 @@ func (sd *SSMDriver) StartSession(ctx context.Context) error {
 	args, err := sd.Args()
 	if err != nil {
 		err = fmt.Errorf("error encountered validating session details: %s", err)
-		return err
+		return nil, nil, err
 	}
 
+	cmd, rawLines, err := sd.startRawProcess(ctx, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sink := sd.logSink()
+
+	ready := make(chan error, 1)
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+
+		successLogLine := fmt.Sprintf("opened for sessionId %s", *sd.Session.SessionId)
+		successSeen := false
+
+		for raw := range rawLines {
+			if raw.text == "" {
+				continue
+			}
+			sink.OnPluginLine(raw.stream, raw.text)
+
+			eventType, matched := classifyPluginLine(raw.text, successLogLine)
+			if matched {
+				sink.OnEvent(SSMEvent{Type: eventType, SessionID: sd.sessionID(), Target: sd.target(), Message: raw.text})
+			}
+
+			if eventType == SSMEventPanic && !successSeen {
+				ready <- fmt.Errorf("exited with a non-zero status")
+				return
+			}
+
+			if eventType == SSMEventTunnelOpened && !successSeen {
+				successSeen = true
+				ready <- nil
+				continue
+			}
+
+			if successSeen {
+				// non-blocking: a slow/absent reader should never stall the plugin's own I/O.
+				select {
+				case lines <- raw.text:
+				default:
+				}
+			}
+		}
+
+		if !successSeen {
+			ready <- fmt.Errorf("unable to determine if a successful tunnel has been established; giving up")
+		}
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return nil, nil, err
+		}
+		return cmd, lines, nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return nil, nil, ctx.Err()
+	}
+}
+
+// pluginLine is one line of output from the session-manager-plugin, tagged with the stream
+// it came from so LogSink.OnPluginLine can report it faithfully.
+type pluginLine struct {
+	stream string
+	text   string
+}
+
+// scanStreamMaxLineBytes raises bufio.Scanner's default 64KB token limit; plugin output
+// occasionally includes single long lines (e.g. a base64 blob or JSON document a remote
+// command prints with no embedded newlines), and silently dropping the rest of the stream
+// past that point is worse than the extra buffer space.
+const scanStreamMaxLineBytes = 1024 * 1024
+
+// scanStream reads r line by line, forwarding each one to out tagged with stream, until r is
+// exhausted.
+func scanStream(r io.Reader, stream string, out chan<- pluginLine, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), scanStreamMaxLineBytes)
+	for scanner.Scan() {
+		out <- pluginLine{stream: stream, text: scanner.Text()}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("error encountered scanning %s: %s", stream, err)
+		// Scanner abandons r without draining it (notably on ErrTooLong, a single line over
+		// scanStreamMaxLineBytes); keep reading and discarding so the plugin's next write to
+		// this pipe doesn't block forever waiting for a reader that's gone away.
+		io.Copy(io.Discard, r)
+	}
+}
+
+// startRawProcess starts the session-manager-plugin with args, merging its stdout/stderr
+// into a single channel of tagged pluginLines. It's shared by startPlugin, which additionally
+// waits for the tunnel-established signal before returning, and RunCommand, which just drains
+// lines until the plugin exits.
+func (sd *SSMDriver) startRawProcess(ctx context.Context, args []string) (*exec.Cmd, <-chan pluginLine, error) {
 	cmd := exec.CommandContext(ctx, sd.PluginName, args...)
-	stdout, err := cmd.StdoutPipe()
+	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	stderr, err := cmd.StderrPipe()
+	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// Aggregate all output into one reader
-	combinedOut := io.MultiReader(stdout, stderr)
+	rawLines, err := sd.startProcessStreams(cmd, stdoutPipe, stderrPipe)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cmd, rawLines, nil
+}
 
+// startProcessStreams starts cmd and merges stdout/stderr into a single channel of tagged
+// pluginLines, closing it once both streams are exhausted. Separated out from
+// startRawProcess so RunCommand can tee the raw readers into its own output buffers first,
+// and still get line-at-a-time access for sink observability without losing byte-exact
+// output to bufio.Scanner's line splitting.
+func (sd *SSMDriver) startProcessStreams(cmd *exec.Cmd, stdout, stderr io.Reader) (<-chan pluginLine, error) {
 	if err := cmd.Start(); err != nil {
-		err = fmt.Errorf("error encountered when calling %s: %s\n", sd.PluginName, err)
+		return nil, fmt.Errorf("error encountered when calling %s: %s", sd.PluginName, err)
+	}
+
+	rawLines := make(chan pluginLine, 32)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go scanStream(stdout, "stdout", rawLines, &wg)
+	go scanStream(stderr, "stderr", rawLines, &wg)
+	go func() {
+		wg.Wait()
+		close(rawLines)
+	}()
+
+	return rawLines, nil
+}
+
+// classifyPluginLine matches a plugin output line against the known significant moments in
+// a session's lifecycle, rather than relying on ad-hoc substring checks scattered through the
+// caller.
+func classifyPluginLine(text, successLogLine string) (SSMEventType, bool) {
+	switch {
+	// Anchored on the Go runtime's actual panic preamble ("panic: <message>") rather than a
+	// bare "panic" substring, which also matches unrelated lines like a remote command
+	// echoing "disabling kernel panic on oops".
+	case strings.Contains(text, "panic: "):
+		return SSMEventPanic, true
+	case strings.Contains(text, successLogLine):
+		return SSMEventTunnelOpened, true
+	case strings.Contains(text, "Waiting for connections"):
+		return SSMEventWaitingForConnections, true
+	case containsAll(text, disconnectMarkers):
+		return SSMEventDisconnected, true
+	default:
+		return "", false
+	}
+}
+
+// logSink returns sd.LogSink, defaulting to a JSONLogSink on stderr the first time it's
+// needed.
+func (sd *SSMDriver) logSink() LogSink {
+	if sd.LogSink == nil {
+		sd.LogSink = NewJSONLogSink(os.Stderr, sd.sessionID(), sd.target())
+	}
+	return sd.LogSink
+}
+
+func (sd *SSMDriver) sessionID() string {
+	if sd.Session != nil && sd.Session.SessionId != nil {
+		return *sd.Session.SessionId
+	}
+	return ""
+}
+
+func (sd *SSMDriver) target() string {
+	if sd.SessionParams.Target != nil {
+		return *sd.SessionParams.Target
+	}
+	return ""
+}
+
+// superviseSession drains a tunnel's output lines looking for the markers the plugin prints
+// when the connection to the instance goes away (or for the output channel simply closing,
+// which means the plugin process exited). When that happens it mints a fresh SSM session
+// (StartSession's SessionId/TokenValue are single-use, so the plugin can't simply be
+// restarted with the old one) and re-establishes the tunnel, honoring MaxReconnects and
+// backing off exponentially between attempts, until the caller calls Stop or the context is
+// canceled.
+func (sd *SSMDriver) superviseSession(ctx context.Context, lines <-chan string, stopCh <-chan struct{}) {
+	backoff := reconnectBackoff
+	reconnects := 0
+
+	for {
+		disconnected := false
+		for line := range lines {
+			// already logged by startPlugin; read here only to notice why the plugin stopped.
+			if !disconnected && containsAll(line, disconnectMarkers) {
+				disconnected = true
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopCh:
+			return
+		default:
+		}
+
+		reason := "plugin exited"
+		if disconnected {
+			reason = "connection to instance was closed"
+		}
+
+		if !shouldReconnect(sd.MaxReconnects, reconnects) {
+			log.Printf("[%s] session tunnel closed (%s); reconnects exhausted or disabled (%d/%d)", sd.PluginName, reason, reconnects, sd.MaxReconnects)
+			return
+		}
+		reconnects++
+
+		log.Printf("[%s] session tunnel closed (%s); reconnecting (attempt %d/%d) in %s", sd.PluginName, reason, reconnects, sd.MaxReconnects, backoff)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return
+		case <-stopCh:
+			return
+		}
+
+		session, err := sd.refreshSession(ctx)
+		if err != nil {
+			log.Printf("[%s] reconnect attempt %d failed to refresh session: %s", sd.PluginName, reconnects, err)
+			continue
+		}
+		sd.setSession(session)
+
+		cmd, newLines, err := sd.startPlugin(ctx)
+		if err != nil {
+			log.Printf("[%s] reconnect attempt %d failed: %s", sd.PluginName, reconnects, err)
+			// startPlugin already killed its own process on failure, but the session
+			// refreshSession just minted is still open on the AWS side; don't leak it.
+			sd.abandonReconnect(nil, session)
+			continue
+		}
+
+		// Record the new process before checking stopCh/ctx below: if Stop races in right
+		// after this point, it must see (and kill) this cmd via getPluginCmd rather than the
+		// old, already-dead one.
+		sd.setPluginCmd(cmd)
+
+		select {
+		case <-ctx.Done():
+			sd.abandonReconnect(cmd, session)
+			return
+		case <-stopCh:
+			// Stop may have already run against the old (already-dead) session and process.
+			// markTerminated keeps TerminateSession from being called twice for this session;
+			// stopPlugin has no such guard and only logs the failed kill if the process is
+			// already gone. This is the only thing that will tear down the session and plugin
+			// this reconnect just brought up.
+			sd.abandonReconnect(cmd, session)
+			return
+		default:
+		}
+
+		lines = newLines
+	}
+}
+
+// abandonReconnect tears down a session and, if one was started, a plugin process left behind
+// by a reconnect attempt that's no longer wanted, whether because Stop ran concurrently or
+// because the reconnect itself failed partway through. cmd may be nil if startPlugin failed
+// before producing one.
+func (sd *SSMDriver) abandonReconnect(cmd *exec.Cmd, session *ssm.StartSessionOutput) {
+	// Kill the local plugin process first; it has no dependency on the AWS call below, and
+	// freeing the forwarded local port shouldn't wait on a possibly-slow API round trip.
+	sd.stopPlugin(cmd)
+
+	if session != nil && session.SessionId != nil && sd.markTerminated(*session.SessionId) {
+		// ctx may already be canceled (often the reason we're here), so use a fresh
+		// background context, bounded so a stuck API call can't hang this goroutine forever.
+		termCtx, cancel := context.WithTimeout(context.Background(), abandonReconnectTerminateTimeout)
+		defer cancel()
+		if _, err := sd.client().TerminateSession(termCtx, &ssm.TerminateSessionInput{SessionId: session.SessionId}); err != nil {
+			log.Printf("[%s] error encountered terminating abandoned SSM session %s: %s", sd.PluginName, *session.SessionId, err)
+			sd.unmarkTerminated(*session.SessionId)
+		}
+	}
+}
+
+// shouldReconnect reports whether superviseSession should attempt another reconnect, given
+// how many it has already made against the configured MaxReconnects.
+func shouldReconnect(maxReconnects, reconnects int) bool {
+	return maxReconnects > 0 && reconnects < maxReconnects
+}
+
+// containsAll reports whether s contains every one of the given substrings.
+func containsAll(s string, substrings []string) bool {
+	for _, substr := range substrings {
+		if !strings.Contains(s, substr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop terminates the SSM session on the AWS side and kills the local session-manager-plugin
+// process, tearing down whatever tunnel StartSession established. It also stops any
+// in-flight reconnect supervisor from bringing the tunnel back up. Stop is safe to call even
+// if StartSession was never called or already failed.
+func (sd *SSMDriver) Stop(ctx context.Context) error {
+	sd.markStopped()
+
+	var termErr error
+	if session := sd.getSession(); session != nil && session.SessionId != nil && sd.markTerminated(*session.SessionId) {
+		if _, err := sd.client().TerminateSession(ctx, &ssm.TerminateSessionInput{SessionId: session.SessionId}); err != nil {
+			termErr = fmt.Errorf("error encountered terminating SSM session %s: %s", *session.SessionId, err)
+			sd.unmarkTerminated(*session.SessionId)
+		}
+	}
+
+	sd.stopPlugin(sd.getPluginCmd())
+	return termErr
+}
+
+// TransferFile copies a file between the Packer host and the target instance. It opens an
+// SSM Session Manager port-forwarding tunnel to the instance's SSH port, the same way
+// StartSession opens one for an interactive shell, then shells out to scp through the
+// forwarded local port. remoteUser is the SSH user to connect as on the target instance (the
+// AMI's default user, e.g. "ec2-user" or "ubuntu"); if empty, scp falls back to the local
+// Packer-host user, which will rarely be correct. The plugin is started with retries/backoff
+// since the tunnel can take a moment to come up, and the forwarded port is always torn down
+// once the transfer finishes, whether or not it succeeded.
+func (sd *SSMDriver) TransferFile(ctx context.Context, localPath, remotePath, remoteUser string, direction TransferDirection) error {
+	localPort, err := sd.forwardedLocalPort()
+	if err != nil {
 		return err
 	}
 
-	output := bufio.NewScanner(combinedOut)
-	successLogLine := fmt.Sprintf("opened for sessionId %s", *sd.Session.SessionId)
-	for output.Scan() {
-		if output.Err() != nil && output.Err() != io.EOF {
+	cmd, err := sd.startPluginWithRetry(ctx)
+	if err != nil {
+		return err
+	}
+	defer sd.stopPlugin(cmd)
+
+	transferCmd := exec.CommandContext(ctx, "scp", scpArgs(localPort, localPath, remotePath, remoteUser, direction)...)
+	out, err := transferCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error encountered transferring %s: %s\n%s", remotePath, err, out)
+	}
+
+	return nil
+}
+
+// startPluginWithRetry wraps startPlugin with a small exponential backoff; the
+// session-manager-plugin occasionally fails to bind its local port on the first attempt
+// when a previous tunnel hasn't fully released it yet.
+func (sd *SSMDriver) startPluginWithRetry(ctx context.Context) (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	var err error
+
+	backoff := transferPluginStartBackoff
+	for attempt := 1; attempt <= transferPluginStartRetries; attempt++ {
+		cmd, _, err = sd.startPlugin(ctx)
+		if err == nil {
+			return cmd, nil
+		}
+
+		log.Printf("[%s] attempt %d/%d to start session failed: %s", sd.PluginName, attempt, transferPluginStartRetries, err)
+		if attempt == transferPluginStartRetries {
 			break
 		}
 
-		out := output.Text()
-		if out != "" {
-			if strings.Contains(out, "panic") {
-				line := fmt.Sprintf("[%s stderr] %s\n", sd.PluginName, out)
-				log.Print(line)
-				return fmt.Errorf("exited with a non-zero status")
-			}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("error encountered starting session after %d attempts: %s", transferPluginStartRetries, err)
+}
 
-			line := fmt.Sprintf("[%s] %s\n", sd.PluginName, out)
-			log.Print(line)
+// stopPlugin kills the session-manager-plugin process and waits for it to exit, releasing
+// the forwarded local port.
+func (sd *SSMDriver) stopPlugin(cmd *exec.Cmd) {
+	if cmd == nil || cmd.Process == nil {
+		return
+	}
 
-			if strings.Contains(line, successLogLine) {
-				return nil
-			}
+	if err := cmd.Process.Kill(); err != nil {
+		log.Printf("[%s] error encountered killing session-manager-plugin: %s", sd.PluginName, err)
+	}
+	cmd.Wait()
+}
+
+// forwardedLocalPort returns the local port the port-forwarding session will bind, as set
+// by the caller in SessionParams.Parameters["localPortNumber"].
+func (sd *SSMDriver) forwardedLocalPort() (string, error) {
+	params, ok := sd.SessionParams.Parameters["localPortNumber"]
+	if !ok || len(params) == 0 || params[0] == "" {
+		return "", fmt.Errorf("SessionParams.Parameters[\"localPortNumber\"] is required to transfer files over the SSM tunnel")
+	}
+
+	return params[0], nil
+}
+
+// scpArgs builds the scp argument list for copying through a tunnel forwarded to
+// 127.0.0.1:localPort, connecting as remoteUser if one is given.
+func scpArgs(localPort, localPath, remotePath, remoteUser string, direction TransferDirection) []string {
+	remote := fmt.Sprintf("127.0.0.1:%s", remotePath)
+	if remoteUser != "" {
+		remote = fmt.Sprintf("%s@%s", remoteUser, remote)
+	}
+
+	if direction == TransferDownload {
+		return []string{"-P", localPort, remote, localPath}
+	}
+
+	return []string{"-P", localPort, localPath, remote}
+}
+
+// RunCommand starts a non-interactive Systems Manager session (SessionParams.DocumentName
+// set to AWS-StartNonInteractiveCommand, or any other document taking a "command"
+// parameter), streams the plugin's output, and blocks until the command completes. It
+// returns the remote command's stdout and stderr along with its exit code, so callers can
+// run scripted probes against the instance (waiting for cloud-init, health checks, starting
+// a port-forward) without hand-rolling a second driver.
+func (sd *SSMDriver) RunCommand(ctx context.Context) (stdout, stderr string, exitCode int, err error) {
+	if sd.PluginName == "" {
+		sd.PluginName = sessionManagerPluginName
+	}
+
+	sentinel, restore, err := sd.appendExitCodeSentinel()
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer restore()
+
+	args, err := sd.Args()
+	if err != nil {
+		return "", "", 0, fmt.Errorf("error encountered validating session details: %s", err)
+	}
+
+	cmd := exec.CommandContext(ctx, sd.PluginName, args...)
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", "", 0, err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	// Tee the raw pipes into their own buffers so the returned stdout/stderr are not rebuilt
+	// from bufio.Scanner's lines (no line-ending normalization or added trailing newline),
+	// while still scanning line-at-a-time for sink observability. stderr is returned as
+	// written; from stdout, extractExitCodeSentinel removes the sentinel line and the line
+	// break before it.
+	var stdoutBuf, stderrBuf bytes.Buffer
+	rawLines, err := sd.startProcessStreams(cmd, io.TeeReader(stdoutPipe, &stdoutBuf), io.TeeReader(stderrPipe, &stderrBuf))
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	sink := sd.logSink()
+
+	// A single consumer serializes every sink.OnPluginLine call, the same way startPlugin's
+	// line-scanning goroutine does for the interactive tunnel, so RunCommand is observable
+	// through the registered LogSink without risking concurrent writes from both streams.
+	for raw := range rawLines {
+		// The exit-code sentinel is an implementation detail of RunCommand, not something the
+		// remote command actually printed; don't leak it to the sink.
+		if raw.text != "" && !strings.HasPrefix(strings.TrimSpace(raw.text), sentinel) {
+			sink.OnPluginLine(raw.stream, raw.text)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", "", 0, fmt.Errorf("error encountered when calling %s: %s", sd.PluginName, err)
+		}
+	}
+
+	stdout, exitCode, err = extractExitCodeSentinel(stdoutBuf.String(), sentinel)
+	if err != nil {
+		return stdoutBuf.String(), stderrBuf.String(), 0, err
+	}
+
+	return stdout, stderrBuf.String(), exitCode, nil
+}
+
+// appendExitCodeSentinel rewrites SessionParams.Parameters["command"] to echo a sentinel
+// line containing the command's exit status once it finishes, returning the sentinel to
+// look for and a restore func that puts the original command back.
+func (sd *SSMDriver) appendExitCodeSentinel() (sentinel string, restore func(), err error) {
+	params, ok := sd.SessionParams.Parameters["command"]
+	if !ok || len(params) == 0 || params[0] == "" {
+		return "", nil, fmt.Errorf("SessionParams.Parameters[\"command\"] is required to run a non-interactive command")
+	}
+
+	original := params[0]
+	sentinel = fmt.Sprintf("%s$?", exitCodeSentinelPrefix)
+	sd.SessionParams.Parameters["command"][0] = fmt.Sprintf("%s; echo \"%s\"", original, sentinel)
+
+	return exitCodeSentinelPrefix, func() { sd.SessionParams.Parameters["command"][0] = original }, nil
+}
+
+// extractExitCodeSentinel pulls the trailing "packer-ssm-exit-code:<n>" line out of the
+// captured stdout and returns the remaining command output plus the parsed exit code.
+func extractExitCodeSentinel(output, sentinel string) (string, int, error) {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, sentinel) {
+			continue
 		}
+
+		code, err := strconv.Atoi(strings.TrimPrefix(line, sentinel))
+		if err != nil {
+			return output, 0, fmt.Errorf("error encountered parsing remote exit code from %q: %s", line, err)
+		}
+
+		remaining := append(lines[:i], lines[i+1:]...)
+		return strings.Join(remaining, "\n"), code, nil
 	}
 
-	// if we get here then something expected happened with the logging.
-	return fmt.Errorf("unable to determine if a successful tunnel has been established; giving up")
+	return output, 0, fmt.Errorf("unable to determine remote exit status; giving up")
 }
 
 func (sd *SSMDriver) Args() ([]string, error) {
@@ -103,12 +794,14 @@ func (sd *SSMDriver) Args() ([]string, error) {
 		return nil, fmt.Errorf("error encountered in reading session parameter details %s", err)
 	}
 
-	// Args must be in this order
+	// Args must be in this order. The profile slot is left blank: credentials are already
+	// resolved into AWSConfig by the time the driver is constructed, so the plugin doesn't
+	// need a profile name to re-resolve them.
 	args := []string{
 		string(sessionDetails),
-		sd.Region,
+		sd.AWSConfig.Region,
 		sessionCommand,
-		sd.ProfileName,
+		"",
 		string(sessionParameters),
 		sd.SessionEndpoint,
 	}
@@ -0,0 +1,303 @@
+package common
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifyPluginLine(t *testing.T) {
+	const successLogLine = "opened for sessionId s-0123456789abcdef0"
+
+	cases := []struct {
+		name      string
+		text      string
+		wantType  SSMEventType
+		wantMatch bool
+	}{
+		{
+			name:      "panic",
+			text:      "2024-01-01 panic: runtime error: invalid memory address",
+			wantType:  SSMEventPanic,
+			wantMatch: true,
+		},
+		{
+			name:      "tunnel opened",
+			text:      "Session opened for sessionId s-0123456789abcdef0",
+			wantType:  SSMEventTunnelOpened,
+			wantMatch: true,
+		},
+		{
+			name:      "waiting for connections",
+			text:      "Waiting for connections...",
+			wantType:  SSMEventWaitingForConnections,
+			wantMatch: true,
+		},
+		{
+			name:      "disconnected",
+			text:      "Connection to instance i-0123456789abcdef0 was closed",
+			wantType:  SSMEventDisconnected,
+			wantMatch: true,
+		},
+		{
+			name:      "connection established is not a disconnect",
+			text:      "Connection to instance i-0123456789abcdef0 established",
+			wantMatch: false,
+		},
+		{
+			name:      "unrelated use of the word panic is not a panic event",
+			text:      "[  0.123456] Kernel command line: ... disabling kernel panic on oops",
+			wantMatch: false,
+		},
+		{
+			name:      "unrelated 'was closed' is not a disconnect",
+			text:      "stdin was closed",
+			wantMatch: false,
+		},
+		{
+			name:      "ordinary line",
+			text:      "Starting session with SessionId: s-0123456789abcdef0",
+			wantMatch: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotType, gotMatch := classifyPluginLine(tc.text, successLogLine)
+			if gotMatch != tc.wantMatch {
+				t.Fatalf("classifyPluginLine(%q) matched = %v, want %v", tc.text, gotMatch, tc.wantMatch)
+			}
+			if gotMatch && gotType != tc.wantType {
+				t.Fatalf("classifyPluginLine(%q) type = %q, want %q", tc.text, gotType, tc.wantType)
+			}
+		})
+	}
+}
+
+func TestExtractExitCodeSentinel(t *testing.T) {
+	const sentinel = exitCodeSentinelPrefix
+
+	cases := []struct {
+		name       string
+		output     string
+		wantStdout string
+		wantCode   int
+		wantErr    bool
+	}{
+		{
+			name:       "success with output",
+			output:     "hello\nworld\n" + sentinel + "0\n",
+			wantStdout: "hello\nworld",
+			wantCode:   0,
+		},
+		{
+			name:       "non-zero exit code",
+			output:     "some error text\n" + sentinel + "17\n",
+			wantStdout: "some error text",
+			wantCode:   17,
+		},
+		{
+			name:       "no trailing newline",
+			output:     "no newline" + "\n" + sentinel + "3",
+			wantStdout: "no newline",
+			wantCode:   3,
+		},
+		{
+			name:    "missing sentinel",
+			output:  "command never finished\n",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric sentinel value",
+			output:  "broken\n" + sentinel + "abc\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotStdout, gotCode, err := extractExitCodeSentinel(tc.output, sentinel)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("extractExitCodeSentinel(%q) expected an error, got none", tc.output)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractExitCodeSentinel(%q) unexpected error: %s", tc.output, err)
+			}
+			if gotStdout != tc.wantStdout {
+				t.Fatalf("extractExitCodeSentinel(%q) stdout = %q, want %q", tc.output, gotStdout, tc.wantStdout)
+			}
+			if gotCode != tc.wantCode {
+				t.Fatalf("extractExitCodeSentinel(%q) code = %d, want %d", tc.output, gotCode, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	t.Run("forwards each line tagged with its stream", func(t *testing.T) {
+		r := strings.NewReader("first\nsecond\nthird")
+		out := make(chan pluginLine, 8)
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		scanStream(r, "stdout", out, &wg)
+		wg.Wait()
+		close(out)
+
+		var got []string
+		for line := range out {
+			if line.stream != "stdout" {
+				t.Fatalf("line.stream = %q, want %q", line.stream, "stdout")
+			}
+			got = append(got, line.text)
+		}
+
+		want := []string{"first", "second", "third"}
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("a line over the max size does not block on the rest of the stream", func(t *testing.T) {
+		tooLong := strings.Repeat("a", scanStreamMaxLineBytes+1)
+		r := strings.NewReader(tooLong + "\nmore output after the long line\n")
+		out := make(chan pluginLine, 8)
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		done := make(chan struct{})
+		go func() {
+			scanStream(r, "stdout", out, &wg)
+			wg.Wait()
+			close(out)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("scanStream did not return for an over-size line; it may be blocked on an undrained reader")
+		}
+
+		for range out {
+			// bufio.Scanner stops at the over-size line, so neither it nor the line after it
+			// is forwarded; this loop only empties out.
+		}
+	})
+}
+
+func TestScpArgs(t *testing.T) {
+	cases := []struct {
+		name       string
+		localPort  string
+		localPath  string
+		remotePath string
+		remoteUser string
+		direction  TransferDirection
+		want       []string
+	}{
+		{
+			name:       "upload without remote user",
+			localPort:  "2222",
+			localPath:  "/tmp/artifact",
+			remotePath: "/opt/artifact",
+			direction:  TransferUpload,
+			want:       []string{"-P", "2222", "/tmp/artifact", "127.0.0.1:/opt/artifact"},
+		},
+		{
+			name:       "upload with remote user",
+			localPort:  "2222",
+			localPath:  "/tmp/artifact",
+			remotePath: "/opt/artifact",
+			remoteUser: "ec2-user",
+			direction:  TransferUpload,
+			want:       []string{"-P", "2222", "/tmp/artifact", "ec2-user@127.0.0.1:/opt/artifact"},
+		},
+		{
+			name:       "download without remote user",
+			localPort:  "2222",
+			localPath:  "/tmp/artifact",
+			remotePath: "/opt/artifact",
+			direction:  TransferDownload,
+			want:       []string{"-P", "2222", "127.0.0.1:/opt/artifact", "/tmp/artifact"},
+		},
+		{
+			name:       "download with remote user",
+			localPort:  "2222",
+			localPath:  "/tmp/artifact",
+			remotePath: "/opt/artifact",
+			remoteUser: "ubuntu",
+			direction:  TransferDownload,
+			want:       []string{"-P", "2222", "ubuntu@127.0.0.1:/opt/artifact", "/tmp/artifact"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := scpArgs(tc.localPort, tc.localPath, tc.remotePath, tc.remoteUser, tc.direction)
+			if len(got) != len(tc.want) {
+				t.Fatalf("scpArgs() = %v, want %v", got, tc.want)
+			}
+			for i := range tc.want {
+				if got[i] != tc.want[i] {
+					t.Fatalf("scpArgs() = %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestShouldReconnect(t *testing.T) {
+	cases := []struct {
+		name          string
+		maxReconnects int
+		reconnects    int
+		want          bool
+	}{
+		{name: "disabled", maxReconnects: 0, reconnects: 0, want: false},
+		{name: "first attempt allowed", maxReconnects: 3, reconnects: 0, want: true},
+		{name: "attempts remaining", maxReconnects: 3, reconnects: 2, want: true},
+		{name: "exhausted", maxReconnects: 3, reconnects: 3, want: false},
+		{name: "negative max is disabled", maxReconnects: -1, reconnects: 0, want: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shouldReconnect(tc.maxReconnects, tc.reconnects); got != tc.want {
+				t.Fatalf("shouldReconnect(%d, %d) = %v, want %v", tc.maxReconnects, tc.reconnects, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContainsAll(t *testing.T) {
+	markers := []string{"Connection to instance", "was closed"}
+
+	cases := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{name: "both present", text: "Connection to instance i-abc was closed", want: true},
+		{name: "only first", text: "Connection to instance i-abc established", want: false},
+		{name: "only second", text: "stdin was closed", want: false},
+		{name: "neither", text: "Waiting for connections...", want: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := containsAll(tc.text, markers); got != tc.want {
+				t.Fatalf("containsAll(%q) = %v, want %v", tc.text, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// SSMEventType classifies a significant moment in a session-manager-plugin's lifecycle, as
+// opposed to an ordinary line of its output.
+type SSMEventType string
+
+const (
+	// SSMEventWaitingForConnections fires when the plugin reports it is listening for the
+	// local end of a port-forwarding tunnel.
+	SSMEventWaitingForConnections SSMEventType = "waiting_for_connections"
+	// SSMEventTunnelOpened fires once the plugin confirms the tunnel to the instance is up.
+	SSMEventTunnelOpened SSMEventType = "tunnel_opened"
+	// SSMEventPanic fires when the plugin itself panics.
+	SSMEventPanic SSMEventType = "panic"
+	// SSMEventDisconnected fires when the plugin reports the connection to the instance was
+	// closed.
+	SSMEventDisconnected SSMEventType = "disconnected"
+)
+
+// SSMEvent describes a typed, significant occurrence observed in a session-manager-plugin's
+// output, as opposed to the raw lines passed to LogSink.OnPluginLine.
+type SSMEvent struct {
+	Type      SSMEventType
+	SessionID string
+	Target    string
+	Message   string
+}
+
+// LogSink receives a session-manager-plugin's output as it runs. OnPluginLine is called for
+// every non-empty line the plugin prints. For a tunnel opened by StartSession or
+// TransferFile, OnEvent is called in addition whenever a line matches one of the typed
+// SSMEventTypes, so callers don't have to re-derive meaning from substrings; RunCommand
+// calls OnPluginLine only.
+// Implementations forward to Packer's UI, a file, CloudWatch, or wherever else operators
+// need SSM sessions to be observable.
+type LogSink interface {
+	OnPluginLine(stream, text string)
+	OnEvent(event SSMEvent)
+}
+
+// JSONLogSink is the default LogSink: it emits newline-delimited JSON, one object per line,
+// with the fields {time, session_id, target, stream, message, level}. This makes SSM
+// sessions observable in CI and lets operators grep by session ID across concurrent builds.
+type JSONLogSink struct {
+	Writer    io.Writer
+	SessionID string
+	Target    string
+}
+
+// NewJSONLogSink returns a JSONLogSink that writes to w, tagging every line with sessionID
+// and target.
+func NewJSONLogSink(w io.Writer, sessionID, target string) *JSONLogSink {
+	if w == nil {
+		w = os.Stderr
+	}
+
+	return &JSONLogSink{Writer: w, SessionID: sessionID, Target: target}
+}
+
+type jsonLogLine struct {
+	Time      string `json:"time"`
+	SessionID string `json:"session_id,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Stream    string `json:"stream"`
+	Message   string `json:"message"`
+	Level     string `json:"level"`
+}
+
+// OnPluginLine implements LogSink.
+func (s *JSONLogSink) OnPluginLine(stream, text string) {
+	s.emit(stream, text, "info")
+}
+
+// OnEvent implements LogSink.
+func (s *JSONLogSink) OnEvent(event SSMEvent) {
+	level := "info"
+	if event.Type == SSMEventPanic {
+		level = "error"
+	}
+
+	s.emit(string(event.Type), event.Message, level)
+}
+
+func (s *JSONLogSink) emit(stream, message, level string) {
+	line := jsonLogLine{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		SessionID: s.SessionID,
+		Target:    s.Target,
+		Stream:    stream,
+		Message:   message,
+		Level:     level,
+	}
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		// Marshaling a struct of plain strings cannot fail in practice; fall back to a
+		// minimal hand-formatted line rather than silently dropping the log.
+		fmt.Fprintf(s.Writer, "{\"stream\":%q,\"message\":%q,\"level\":\"error\"}\n", stream, message)
+		return
+	}
+
+	s.Writer.Write(append(encoded, '\n'))
+}
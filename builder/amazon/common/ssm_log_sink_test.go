@@ -0,0 +1,92 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogSinkOnPluginLine(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLogSink(&buf, "s-0123456789abcdef0", "i-0123456789abcdef0")
+
+	sink.OnPluginLine("stdout", "hello world")
+
+	var line jsonLogLine
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("unmarshaling emitted line: %s (line: %s)", err, buf.String())
+	}
+
+	if line.SessionID != "s-0123456789abcdef0" {
+		t.Errorf("session_id = %q, want %q", line.SessionID, "s-0123456789abcdef0")
+	}
+	if line.Target != "i-0123456789abcdef0" {
+		t.Errorf("target = %q, want %q", line.Target, "i-0123456789abcdef0")
+	}
+	if line.Stream != "stdout" {
+		t.Errorf("stream = %q, want %q", line.Stream, "stdout")
+	}
+	if line.Message != "hello world" {
+		t.Errorf("message = %q, want %q", line.Message, "hello world")
+	}
+	if line.Level != "info" {
+		t.Errorf("level = %q, want %q", line.Level, "info")
+	}
+	if line.Time == "" {
+		t.Error("time is empty, want an RFC3339Nano timestamp")
+	}
+	if !strings.HasSuffix(buf.String(), "\n") {
+		t.Error("emitted line does not end with a newline")
+	}
+}
+
+func TestJSONLogSinkOnEvent(t *testing.T) {
+	cases := []struct {
+		name      string
+		event     SSMEvent
+		wantLevel string
+	}{
+		{
+			name:      "tunnel opened is info",
+			event:     SSMEvent{Type: SSMEventTunnelOpened, Message: "tunnel is up"},
+			wantLevel: "info",
+		},
+		{
+			name:      "panic is error",
+			event:     SSMEvent{Type: SSMEventPanic, Message: "plugin panicked"},
+			wantLevel: "error",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			sink := NewJSONLogSink(&buf, "s-1", "i-1")
+
+			sink.OnEvent(tc.event)
+
+			var line jsonLogLine
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatalf("unmarshaling emitted line: %s (line: %s)", err, buf.String())
+			}
+
+			if line.Stream != string(tc.event.Type) {
+				t.Errorf("stream = %q, want %q", line.Stream, tc.event.Type)
+			}
+			if line.Message != tc.event.Message {
+				t.Errorf("message = %q, want %q", line.Message, tc.event.Message)
+			}
+			if line.Level != tc.wantLevel {
+				t.Errorf("level = %q, want %q", line.Level, tc.wantLevel)
+			}
+		})
+	}
+}
+
+func TestNewJSONLogSinkDefaultsWriter(t *testing.T) {
+	sink := NewJSONLogSink(nil, "s-1", "i-1")
+	if sink.Writer == nil {
+		t.Error("NewJSONLogSink(nil, ...) left Writer nil, want a default writer")
+	}
+}